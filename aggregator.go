@@ -0,0 +1,292 @@
+// Craig Hesling
+// May 25, 2018
+//
+// This file defines the set of aggregation strategies that can be applied
+// to a topic's window of samples. Each strategy implements the Aggregator
+// interface and is selected per-topic with the Mode config parameter.
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Aggregator reduces a stream of samples down to a single representative
+// value. Implementations must ignore NaN samples, the same way the
+// original hard-coded mean did, and must return a well-defined value (NaN
+// is acceptable) before any samples have been seen.
+type Aggregator interface {
+	// Update folds value into the aggregator's running state. NaN values
+	// are ignored.
+	Update(value float64)
+	// Value returns the aggregator's current result.
+	Value() float64
+	// Reset clears all running state back to startup.
+	Reset()
+}
+
+const (
+	modeMean     = "mean"
+	modeEWMA     = "ewma"
+	modeMedian   = "median"
+	modeStddev   = "stddev"
+	modeVariance = "variance"
+	modeMin      = "min"
+	modeMax      = "max"
+	modeP50      = "p50"
+	modeP90      = "p90"
+	modeP99      = "p99"
+)
+
+const (
+	defaultMode      = modeMean
+	defaultEWMAAlpha = 0.3
+)
+
+// newAggregator builds the Aggregator named by mode. EWMA's smoothing
+// factor can be tuned by appending it after a colon, e.g. "ewma:0.1".
+func newAggregator(mode string) (Aggregator, error) {
+	name := mode
+	alpha := defaultEWMAAlpha
+	if idx := strings.Index(mode, ":"); idx >= 0 {
+		name = mode[:idx]
+		val, err := strconv.ParseFloat(mode[idx+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parameter for Mode %q: %v", mode, err)
+		}
+		alpha = val
+	}
+
+	if name == modeEWMA && (alpha <= 0 || alpha > 1) {
+		return nil, fmt.Errorf("invalid parameter for Mode %q: alpha must be in (0, 1]", mode)
+	}
+
+	switch name {
+	case modeMean, "":
+		return &meanAggregator{}, nil
+	case modeEWMA:
+		return &ewmaAggregator{alpha: alpha, value: math.NaN()}, nil
+	case modeMedian:
+		return newMedianAggregator(), nil
+	case modeStddev:
+		return &stddevAggregator{}, nil
+	case modeVariance:
+		return &stddevAggregator{variance: true}, nil
+	case modeMin:
+		return &minmaxAggregator{value: math.NaN(), less: func(a, b float64) bool { return a < b }}, nil
+	case modeMax:
+		return &minmaxAggregator{value: math.NaN(), less: func(a, b float64) bool { return a > b }}, nil
+	case modeP50:
+		return newPercentileAggregator(0.50), nil
+	case modeP90:
+		return newPercentileAggregator(0.90), nil
+	case modeP99:
+		return newPercentileAggregator(0.99), nil
+	default:
+		return nil, fmt.Errorf("unknown Mode %q", mode)
+	}
+}
+
+// meanAggregator is the original, simple arithmetic mean.
+type meanAggregator struct {
+	sum   float64
+	count int
+}
+
+func (a *meanAggregator) Update(value float64) {
+	if math.IsNaN(value) {
+		return
+	}
+	a.sum += value
+	a.count++
+}
+
+func (a *meanAggregator) Value() float64 {
+	return a.sum / float64(a.count)
+}
+
+func (a *meanAggregator) Reset() {
+	a.sum = 0
+	a.count = 0
+}
+
+// ewmaAggregator is an exponentially-weighted moving average with
+// configurable smoothing factor alpha in (0, 1].
+type ewmaAggregator struct {
+	alpha   float64
+	value   float64
+	started bool
+}
+
+func (a *ewmaAggregator) Update(value float64) {
+	if math.IsNaN(value) {
+		return
+	}
+	if !a.started {
+		a.value = value
+		a.started = true
+		return
+	}
+	a.value = a.alpha*value + (1-a.alpha)*a.value
+}
+
+func (a *ewmaAggregator) Value() float64 {
+	return a.value
+}
+
+func (a *ewmaAggregator) Reset() {
+	a.value = math.NaN()
+	a.started = false
+}
+
+// stddevAggregator computes the sample variance using Welford's online
+// algorithm, which avoids buffering samples for a second pass, and
+// reports either the variance directly or its square root, the sample
+// standard deviation, depending on variance.
+type stddevAggregator struct {
+	count    int
+	mean     float64
+	m2       float64
+	variance bool
+}
+
+func (a *stddevAggregator) Update(value float64) {
+	if math.IsNaN(value) {
+		return
+	}
+	a.count++
+	delta := value - a.mean
+	a.mean += delta / float64(a.count)
+	a.m2 += delta * (value - a.mean)
+}
+
+func (a *stddevAggregator) Value() float64 {
+	if a.count < 2 {
+		return math.NaN()
+	}
+	v := a.m2 / float64(a.count-1)
+	if a.variance {
+		return v
+	}
+	return math.Sqrt(v)
+}
+
+func (a *stddevAggregator) Reset() {
+	a.count = 0
+	a.mean = 0
+	a.m2 = 0
+}
+
+// minmaxAggregator tracks either the minimum or maximum seen value,
+// depending on the less function it's constructed with.
+type minmaxAggregator struct {
+	value   float64
+	started bool
+	less    func(a, b float64) bool
+}
+
+func (a *minmaxAggregator) Update(value float64) {
+	if math.IsNaN(value) {
+		return
+	}
+	if !a.started || a.less(value, a.value) {
+		a.value = value
+		a.started = true
+	}
+}
+
+func (a *minmaxAggregator) Value() float64 {
+	return a.value
+}
+
+func (a *minmaxAggregator) Reset() {
+	a.value = math.NaN()
+	a.started = false
+}
+
+// medianAggregator computes the median of the samples seen since the last
+// Reset by sorting them on Value. An online structure (a two-heap median)
+// would avoid that sort, but it would buy nothing here: calculateAverage
+// already Resets and replays every retained sample on each call, because the
+// windows in window.go drop their oldest samples as new ones arrive or age
+// out, and an Aggregator has no way to retract a sample once it has been
+// folded in. Since the full history has to be kept and replayed
+// anyway, sorting it directly is simpler and no more expensive than
+// maintaining a second incremental structure alongside it. percentileAggregator
+// below takes the same approach.
+type medianAggregator struct {
+	values []float64
+}
+
+func newMedianAggregator() *medianAggregator {
+	return &medianAggregator{}
+}
+
+func (a *medianAggregator) Update(value float64) {
+	if math.IsNaN(value) {
+		return
+	}
+	a.values = append(a.values, value)
+}
+
+func (a *medianAggregator) Value() float64 {
+	if len(a.values) == 0 {
+		return math.NaN()
+	}
+	sorted := append([]float64(nil), a.values...)
+	sortFloat64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+func (a *medianAggregator) Reset() {
+	a.values = a.values[:0]
+}
+
+// percentileAggregator computes quantile p of the samples seen since the
+// last Reset by picking the sorted sample at index p*(n-1), rounded down;
+// no interpolation is done between neighboring samples.
+type percentileAggregator struct {
+	p      float64
+	values []float64
+}
+
+func newPercentileAggregator(p float64) *percentileAggregator {
+	return &percentileAggregator{p: p}
+}
+
+func (a *percentileAggregator) Update(value float64) {
+	if math.IsNaN(value) {
+		return
+	}
+	a.values = append(a.values, value)
+}
+
+func (a *percentileAggregator) Value() float64 {
+	if len(a.values) == 0 {
+		return math.NaN()
+	}
+	sorted := append([]float64(nil), a.values...)
+	sortFloat64s(sorted)
+	idx := int(a.p * float64(len(sorted)-1))
+	return sorted[idx]
+}
+
+func (a *percentileAggregator) Reset() {
+	a.values = a.values[:0]
+}
+
+// sortFloat64s sorts a small slice in place without requiring sort.Float64s
+// semantics around NaN, which never reach this slice.
+func sortFloat64s(s []float64) {
+	for i := 1; i < len(s); i++ {
+		for j := i; j > 0 && s[j-1] > s[j]; j-- {
+			s[j-1], s[j] = s[j], s[j-1]
+		}
+	}
+}
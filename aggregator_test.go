@@ -0,0 +1,184 @@
+// Craig Hesling
+// May 25, 2018
+//
+// Table tests for the Aggregator implementations in aggregator.go.
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAggregators(t *testing.T) {
+	tests := []struct {
+		name    string
+		agg     Aggregator
+		samples []float64
+		want    float64
+	}{
+		{
+			name:    "mean",
+			agg:     &meanAggregator{},
+			samples: []float64{1, 2, 3, 4},
+			want:    2.5,
+		},
+		{
+			name:    "mean skips NaN",
+			agg:     &meanAggregator{},
+			samples: []float64{1, math.NaN(), 3},
+			want:    2,
+		},
+		{
+			name:    "ewma",
+			agg:     &ewmaAggregator{alpha: 0.5, value: math.NaN()},
+			samples: []float64{10, 20},
+			want:    15, // seeded at 10, then 0.5*20 + 0.5*10
+		},
+		{
+			name:    "ewma skips NaN",
+			agg:     &ewmaAggregator{alpha: 0.5, value: math.NaN()},
+			samples: []float64{10, math.NaN(), 20},
+			want:    15,
+		},
+		{
+			name:    "stddev",
+			agg:     &stddevAggregator{},
+			samples: []float64{2, 4, 4, 4, 5, 5, 7, 9},
+			want:    2.1380899352993947, // sample stddev of the classic Welford example
+		},
+		{
+			name:    "variance",
+			agg:     &stddevAggregator{variance: true},
+			samples: []float64{2, 4, 4, 4, 5, 5, 7, 9},
+			want:    4.571428571428571, // square of the stddev above
+		},
+		{
+			name:    "min",
+			agg:     &minmaxAggregator{value: math.NaN(), less: func(a, b float64) bool { return a < b }},
+			samples: []float64{3, 1, 2},
+			want:    1,
+		},
+		{
+			name:    "min skips NaN",
+			agg:     &minmaxAggregator{value: math.NaN(), less: func(a, b float64) bool { return a < b }},
+			samples: []float64{3, math.NaN(), 1},
+			want:    1,
+		},
+		{
+			name:    "max",
+			agg:     &minmaxAggregator{value: math.NaN(), less: func(a, b float64) bool { return a > b }},
+			samples: []float64{3, 1, 2},
+			want:    3,
+		},
+		{
+			name:    "median odd",
+			agg:     newMedianAggregator(),
+			samples: []float64{5, 1, 3},
+			want:    3,
+		},
+		{
+			name:    "median even",
+			agg:     newMedianAggregator(),
+			samples: []float64{1, 2, 3, 4},
+			want:    2.5,
+		},
+		{
+			name:    "median skips NaN",
+			agg:     newMedianAggregator(),
+			samples: []float64{1, math.NaN(), 3, 5},
+			want:    3,
+		},
+		{
+			name:    "p50 matches median",
+			agg:     newPercentileAggregator(0.50),
+			samples: []float64{1, 2, 3, 4, 5},
+			want:    3,
+		},
+		{
+			name:    "p100 is the max",
+			agg:     newPercentileAggregator(1),
+			samples: []float64{5, 1, 3, 2, 4},
+			want:    5,
+		},
+		{
+			name:    "percentile skips NaN",
+			agg:     newPercentileAggregator(0),
+			samples: []float64{math.NaN(), 3, 1, 2},
+			want:    1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, s := range tc.samples {
+				tc.agg.Update(s)
+			}
+			if got := tc.agg.Value(); math.Abs(got-tc.want) > 1e-9 {
+				t.Errorf("Value() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestAggregatorStartupValue checks that every Aggregator reports a
+// well-defined value before any sample has been seen, as required of new
+// Aggregator implementations.
+func TestAggregatorStartupValue(t *testing.T) {
+	aggs := map[string]Aggregator{
+		"mean":       &meanAggregator{},
+		"ewma":       &ewmaAggregator{alpha: 0.5, value: math.NaN()},
+		"stddev":     &stddevAggregator{},
+		"variance":   &stddevAggregator{variance: true},
+		"min":        &minmaxAggregator{value: math.NaN(), less: func(a, b float64) bool { return a < b }},
+		"max":        &minmaxAggregator{value: math.NaN(), less: func(a, b float64) bool { return a > b }},
+		"median":     newMedianAggregator(),
+		"percentile": newPercentileAggregator(0.90),
+	}
+
+	for name, agg := range aggs {
+		t.Run(name, func(t *testing.T) {
+			got := agg.Value()
+			if name == "mean" {
+				// meanAggregator divides by a zero count, matching the
+				// original hard-coded mean's startup behavior.
+				if !math.IsNaN(got) {
+					t.Errorf("Value() = %v, want NaN", got)
+				}
+				return
+			}
+			if !math.IsNaN(got) {
+				t.Errorf("Value() = %v, want NaN", got)
+			}
+		})
+	}
+}
+
+// TestAggregatorReset checks that Reset returns an Aggregator to its
+// startup value and that it can be fed a fresh sequence of samples
+// afterward.
+func TestAggregatorReset(t *testing.T) {
+	agg := newMedianAggregator()
+	agg.Update(1)
+	agg.Update(2)
+	agg.Update(3)
+	agg.Reset()
+	if got := agg.Value(); !math.IsNaN(got) {
+		t.Fatalf("Value() after Reset = %v, want NaN", got)
+	}
+	agg.Update(10)
+	agg.Update(20)
+	if got, want := agg.Value(), 15.0; got != want {
+		t.Fatalf("Value() after Reset and replay = %v, want %v", got, want)
+	}
+}
+
+func TestNewAggregatorVariance(t *testing.T) {
+	agg, err := newAggregator(modeVariance)
+	if err != nil {
+		t.Fatalf("newAggregator(%q) returned error: %v", modeVariance, err)
+	}
+	sa, ok := agg.(*stddevAggregator)
+	if !ok || !sa.variance {
+		t.Fatalf("newAggregator(%q) = %#v, want a variance-mode stddevAggregator", modeVariance, agg)
+	}
+}
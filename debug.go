@@ -0,0 +1,183 @@
+// Craig Hesling
+// May 25, 2018
+//
+// This file implements a small HTTP admin server, in the spirit of the
+// micro framework's debug/handler package, that exposes per-device
+// internal state for troubleshooting along with Kubernetes-style
+// liveness/readiness probes.
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	deviceRegistryMu sync.Mutex
+	deviceRegistry   = make(map[string]*Device)
+)
+
+// registerDevice makes a linked device visible to the debug endpoint.
+func registerDevice(id string, d *Device) {
+	deviceRegistryMu.Lock()
+	defer deviceRegistryMu.Unlock()
+	deviceRegistry[id] = d
+}
+
+// unregisterDevice removes a device from the debug endpoint.
+func unregisterDevice(id string) {
+	deviceRegistryMu.Lock()
+	defer deviceRegistryMu.Unlock()
+	delete(deviceRegistry, id)
+}
+
+// clientConnected and serviceReady back the /healthz and /readyz probes.
+// They are read and written with the atomic package rather than d.mu
+// because they describe the service as a whole, not a single device.
+var (
+	clientConnected int32
+	serviceReady    int32
+)
+
+func setClientConnected(connected bool) {
+	if connected {
+		atomic.StoreInt32(&clientConnected, 1)
+	} else {
+		atomic.StoreInt32(&clientConnected, 0)
+	}
+}
+
+func isClientConnected() bool {
+	return atomic.LoadInt32(&clientConnected) == 1
+}
+
+func setServiceReady(ready bool) {
+	if ready {
+		atomic.StoreInt32(&serviceReady, 1)
+	} else {
+		atomic.StoreInt32(&serviceReady, 0)
+	}
+}
+
+func isServiceReady() bool {
+	return atomic.LoadInt32(&serviceReady) == 1
+}
+
+// topicState is the debug snapshot of a single input/output topic pair.
+type topicState struct {
+	InputTopic    string     `json:"input_topic"`
+	OutputTopic   string     `json:"output_topic"`
+	Samples       []*float64 `json:"samples"`
+	LastAverage   *float64   `json:"last_average,omitempty"`
+	LastMessageAt *time.Time `json:"last_message_at,omitempty"`
+	ParseFailures int        `json:"parse_failures"`
+}
+
+// deviceState is the debug snapshot of a single linked device.
+type deviceState struct {
+	DeviceID string       `json:"device_id"`
+	Topics   []topicState `json:"topics"`
+}
+
+// floatOrNull maps NaN to a JSON null, and everything else to itself, so
+// the window contents round-trip as a readable JSON number array.
+func floatOrNull(v float64) *float64 {
+	if math.IsNaN(v) {
+		return nil
+	}
+	return &v
+}
+
+// snapshot captures the device's current internal state for the debug
+// endpoint.
+func (d *Device) snapshot(deviceID string) deviceState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	topics := make([]topicState, len(d.intopics))
+	for i, intopic := range d.intopics {
+		vals := d.windows[i].values()
+		samples := make([]*float64, len(vals))
+		for j, v := range vals {
+			samples[j] = floatOrNull(v)
+		}
+
+		ts := topicState{
+			InputTopic:    intopic,
+			OutputTopic:   d.outtopics[i],
+			Samples:       samples,
+			LastAverage:   floatOrNull(d.lastAvg[i]),
+			ParseFailures: d.parseFailures[i],
+		}
+		if !d.lastMessageAt[i].IsZero() {
+			at := d.lastMessageAt[i]
+			ts.LastMessageAt = &at
+		}
+		topics[i] = ts
+	}
+
+	return deviceState{DeviceID: deviceID, Topics: topics}
+}
+
+func handleDevices(w http.ResponseWriter, r *http.Request) {
+	deviceRegistryMu.Lock()
+	ids := make([]string, 0, len(deviceRegistry))
+	for id := range deviceRegistry {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	devices := make([]deviceState, 0, len(ids))
+	for _, id := range ids {
+		devices = append(devices, deviceRegistry[id].snapshot(id))
+	}
+	deviceRegistryMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		DeviceIDs []string      `json:"device_ids"`
+		Devices   []deviceState `json:"devices"`
+	}{DeviceIDs: ids, Devices: devices})
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if isClientConnected() {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("framework client not connected"))
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if isServiceReady() {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ready"))
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("not ready"))
+}
+
+// startDebugServer starts the debug/health admin endpoint in the
+// background and returns the *http.Server so the caller can shut it down.
+func startDebugServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/devices", handleDevices)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error("Debug server failed: ", err)
+		}
+	}()
+	return srv
+}
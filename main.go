@@ -11,12 +11,18 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"math"
+	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/openchirp/framework"
 	"github.com/openchirp/framework/rest"
@@ -33,6 +39,7 @@ const (
 	configKeyInputTopics  = "InputTopics"
 	configKeyOutputTopics = "OutputTopics"
 	configWindowsSizes    = "WindowSizes"
+	configKeyMode         = "Mode"
 )
 
 var configParams = []rest.ServiceConfigParameter{
@@ -50,8 +57,14 @@ var configParams = []rest.ServiceConfigParameter{
 	},
 	rest.ServiceConfigParameter{
 		Name:        configWindowsSizes,
-		Description: "Comma separated list of corresponding window sizes",
-		Example:     "2, 4",
+		Description: "Comma separated list of corresponding window sizes, either a sample count or a duration (e.g. 30s, 5m, 1h)",
+		Example:     "10, 30s, 1h",
+		Required:    false,
+	},
+	rest.ServiceConfigParameter{
+		Name:        configKeyMode,
+		Description: "Comma separated list of corresponding aggregation modes (mean, ewma[:alpha], median, stddev, variance, min, max, p50, p90, p99)",
+		Example:     "mean, ewma:0.2",
 		Required:    false,
 	},
 }
@@ -59,6 +72,9 @@ var configParams = []rest.ServiceConfigParameter{
 const (
 	defaultWindowSize        = 2
 	defaultOutputTopicSuffix = "_avg"
+	// tickerInterval is how often a device checks its duration-based
+	// windows for samples that have aged out since the last message.
+	tickerInterval = 1 * time.Second
 )
 
 const (
@@ -67,6 +83,85 @@ const (
 	runningStatus = true
 )
 
+const defaultShutdownTimeout = 10 * time.Second
+
+// serviceCtx is the root lifecycle context, cancelled once a shutdown
+// signal is received. The framework's NewDevice factory takes no
+// arguments, so Devices pick it up through this package-level variable
+// rather than having it passed in directly.
+var serviceCtx context.Context
+
+// shutdownTimeout bounds how long a Device is given to tear down its
+// background goroutines on unlink, and how long run waits for the metrics
+// and debug servers to stop during service shutdown before forcing exit.
+var shutdownTimeout = defaultShutdownTimeout
+
+// Sentinel errors returned by parseTopicConfig so callers can map a
+// failure back to the short status string the framework expects.
+var (
+	errInvalidWindowSize = errors.New("Failed to parse WindowSize")
+	errInvalidMode       = errors.New("Failed to parse Mode")
+)
+
+// parseTopicConfig parses the InputTopics/OutputTopics/WindowSizes/Mode
+// config parameters into parallel per-topic slices, used by both
+// ProcessLink and ProcessConfigChange.
+func parseTopicConfig(config map[string]string) (inputTopics, outtopics []string, windows []*window, aggregators []Aggregator, err error) {
+	inputTopics = commaList(config[configKeyInputTopics])
+	outputTopics := commaList(config[configKeyOutputTopics])
+	windowSizes := commaList(config[configWindowsSizes])
+	modes := commaList(config[configKeyMode])
+
+	outtopics = make([]string, len(inputTopics))
+	windows = make([]*window, len(inputTopics))
+	aggregators = make([]Aggregator, len(inputTopics))
+
+	for i, intopic := range inputTopics {
+		if i < len(outputTopics) {
+			outtopics[i] = outputTopics[i]
+		} else {
+			// if no output topic specified, simply append a suffix to the topic
+			outtopics[i] = intopic + defaultOutputTopicSuffix
+		}
+
+		spec := ""
+		if i < len(windowSizes) {
+			spec = windowSizes[i]
+		}
+		if spec == "" {
+			windows[i] = &window{kind: windowByCount, capacity: defaultWindowSize}
+		} else {
+			windows[i], err = parseWindowSpec(spec)
+			if err != nil {
+				return nil, nil, nil, nil, fmt.Errorf("%w: given %q: %v", errInvalidWindowSize, spec, err)
+			}
+		}
+
+		mode := defaultMode
+		if i < len(modes) {
+			mode = modes[i]
+		}
+		aggregators[i], err = newAggregator(mode)
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("%w: given %q: %v", errInvalidMode, mode, err)
+		}
+	}
+	return inputTopics, outtopics, windows, aggregators, nil
+}
+
+// newTopicStats allocates the per-topic bookkeeping used by the debug
+// endpoint: the last published average (NaN until one exists), the time
+// of the last received message, and a parse-failure counter.
+func newTopicStats(n int) (lastAvg []float64, lastMessageAt []time.Time, parseFailures []int) {
+	lastAvg = make([]float64, n)
+	for i := range lastAvg {
+		lastAvg[i] = math.NaN()
+	}
+	lastMessageAt = make([]time.Time, n)
+	parseFailures = make([]int, n)
+	return
+}
+
 func commaList(str string) []string {
 	nospacestr := strings.Replace(str, " ", "", -1)
 	elements := strings.Split(nospacestr, ",")
@@ -76,11 +171,19 @@ func commaList(str string) []string {
 	return elements
 }
 
-// Device holds the device specific last values and target topics for the difference.
+// Device holds the device specific windows and target topics for the aggregate.
 type Device struct {
-	outtopics  []string
-	lastvalues [][]float64
-	nextindex  []int
+	mu            sync.Mutex
+	ctrl          *framework.DeviceControl
+	intopics      []string
+	outtopics     []string
+	windows       []*window
+	aggregators   []Aggregator
+	lastAvg       []float64
+	lastMessageAt []time.Time
+	parseFailures []int
+	cancel        context.CancelFunc
+	done          chan struct{}
 }
 
 // NewDevice is called by the framework when a new device has been linked.
@@ -89,26 +192,82 @@ func NewDevice() framework.Device {
 	return framework.Device(d)
 }
 
-func (d *Device) addLastValue(topicIndex int, value float64) {
-	nextIndex := d.nextindex[topicIndex]
-	d.lastvalues[topicIndex][nextIndex] = value
-	d.nextindex[topicIndex] = (nextIndex + 1) % len(d.lastvalues[topicIndex])
+// calculateAverage will compute the configured aggregate of the topic's
+// window, oldest to newest. This means that it may generate a startup
+// value with less values than the specified window size.
+//
+// The aggregator is reset and replayed from scratch on every call rather
+// than fed incrementally as samples arrive and expire: windows drop their
+// oldest samples (a duration-based window also as they age out), and the
+// Aggregator interface (aggregator.go) has no way to retract a sample once
+// it has been folded in. Replaying from window.values() keeps every
+// aggregator consistent with the window's current contents.
+func (d *Device) calculateAverage(topicIndex int) float64 {
+	agg := d.aggregators[topicIndex]
+	agg.Reset()
+	for _, val := range d.windows[topicIndex].values() {
+		agg.Update(val)
+	}
+	return agg.Value()
 }
 
-// calculateAverage will compute the average of lastvalues avaliable.
-// This means that it may generate a startup average with less values than
-// the specified window size.
-func (d *Device) calculateAverage(topicIndex int) float64 {
-	var count = len(d.lastvalues[topicIndex])
-	var sum float64
-	for _, val := range d.lastvalues[topicIndex] {
-		if math.IsNaN(val) {
-			count--
-			continue
+// watchExpiry periodically evicts stale samples from any duration-based
+// windows and republishes their average, so a window that empties out
+// without new input still reflects the shrinking average rather than a
+// stale one. It exits when ctx is cancelled, signaling its exit on done.
+func (d *Device) watchExpiry(ctx context.Context, logitem *log.Entry, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(tickerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			d.mu.Lock()
+			for i, w := range d.windows {
+				if n := w.evict(now); n > 0 {
+					avg := d.calculateAverage(i)
+					outtopic := d.outtopics[i]
+					logitem.Debugf("window for topic index %d shrank by %d expired samples | avg=%s", i, n, utils.FormatFloat64(avg))
+					d.lastAvg[i] = avg
+					metricWindowFill.WithLabelValues(d.ctrl.Id(), d.intopics[i]).Set(float64(len(w.samples)))
+					metricAveragesPublished.WithLabelValues(d.ctrl.Id(), outtopic).Inc()
+					d.ctrl.Publish(outtopic, utils.FormatFloat64(avg))
+				}
+			}
+			d.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close stops the device's background goroutines, waiting for them to
+// exit or for ctx to expire, whichever comes first.
+func (d *Device) Close(ctx context.Context) {
+	if d.cancel == nil {
+		return
+	}
+	d.cancel()
+	if d.done == nil {
+		return
+	}
+	select {
+	case <-d.done:
+	case <-ctx.Done():
+		log.Warn("Device did not shut down before deadline")
+	}
+}
+
+// hasDurationWindow reports whether any of the device's topics use a
+// duration-based window, which requires the background expiry ticker.
+func (d *Device) hasDurationWindow() bool {
+	for _, w := range d.windows {
+		if w.kind == windowByDuration {
+			return true
 		}
-		sum += val
 	}
-	return sum / float64(count)
+	return false
 }
 
 // ProcessLink is called once, during the initial setup of a
@@ -117,45 +276,39 @@ func (d *Device) ProcessLink(ctrl *framework.DeviceControl) string {
 	logitem := log.WithField("deviceid", ctrl.Id())
 	logitem.Debug("Linking with config:", ctrl.Config())
 
-	// Allows space in comma seperated list
-	inputTopics := commaList(ctrl.Config()[configKeyInputTopics])
-	outputTopics := commaList(ctrl.Config()[configKeyOutputTopics])
-	windowSizes := commaList(ctrl.Config()[configWindowsSizes])
-
-	d.outtopics = make([]string, len(inputTopics))
-	d.lastvalues = make([][]float64, len(inputTopics))
-	d.nextindex = make([]int, len(inputTopics))
-
-	for i, intopic := range inputTopics {
-		var outtopic string
-		if i < len(outputTopics) {
-			outtopic = outputTopics[i]
-		} else {
-			// if no putput topic specified, simply append a _diff to the topic
-			outtopic = intopic + defaultOutputTopicSuffix
+	inputTopics, outtopics, windows, aggregators, err := parseTopicConfig(ctrl.Config())
+	if err != nil {
+		logitem.Warn(err)
+		switch {
+		case errors.Is(err, errInvalidWindowSize):
+			return errInvalidWindowSize.Error()
+		case errors.Is(err, errInvalidMode):
+			return errInvalidMode.Error()
 		}
-		d.outtopics[i] = outtopic
+		return err.Error()
+	}
 
-		var winsize int = defaultWindowSize
-		if i < len(windowSizes) {
-			val, err := strconv.ParseInt(windowSizes[i], 10, 32)
-			if err != nil {
-				logitem.Warnf("Failed to parse WindowSize. Given \"%s\".", windowSizes[i])
-				return "Failed to parse WindowSize"
-			}
-			if val > 0 {
-				winsize = int(val)
-			}
-		}
-		d.lastvalues[i] = make([]float64, winsize)
-		// Initialize to to NaN
-		for vali := range d.lastvalues[i] {
-			d.lastvalues[i][vali] = math.NaN()
-		}
+	d.ctrl = ctrl
+	d.intopics = inputTopics
+	d.outtopics = outtopics
+	d.windows = windows
+	d.aggregators = aggregators
+	d.lastAvg, d.lastMessageAt, d.parseFailures = newTopicStats(len(inputTopics))
+
+	var deviceCtx context.Context
+	deviceCtx, d.cancel = context.WithCancel(serviceCtx)
 
+	for i, intopic := range inputTopics {
 		ctrl.Subscribe(intopic, i)
 	}
 
+	if d.hasDurationWindow() {
+		d.done = make(chan struct{})
+		go d.watchExpiry(deviceCtx, logitem, d.done)
+	}
+
+	registerDevice(ctrl.Id(), d)
+
 	logitem.Debug("Finished Linking")
 
 	// This message is sent to the service status for the linking device
@@ -167,14 +320,91 @@ func (d *Device) ProcessLink(ctrl *framework.DeviceControl) string {
 func (d *Device) ProcessUnlink(ctrl *framework.DeviceControl) {
 	logitem := log.WithField("deviceid", ctrl.Id())
 	logitem.Debug("Unlinked:")
+
+	unregisterDevice(ctrl.Id())
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	d.Close(ctx)
 }
 
-// ProcessConfigChange is ignored in this case.
+// ProcessConfigChange re-plumbs subscriptions and window buffers when a
+// linked device's InputTopics, OutputTopics, WindowSizes, or Mode change,
+// without requiring an unlink/relink cycle.
 func (d *Device) ProcessConfigChange(ctrl *framework.DeviceControl, cchanges, coriginal map[string]string) (string, bool) {
 	logitem := log.WithField("deviceid", ctrl.Id())
+	logitem.Debug("Processing Config Change:", cchanges)
+
+	inputTopics, outtopics, windows, aggregators, err := parseTopicConfig(ctrl.Config())
+	if err != nil {
+		logitem.Warn(err)
+		return err.Error(), false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	oldIndex := make(map[string]int, len(d.intopics))
+	for i, topic := range d.intopics {
+		oldIndex[topic] = i
+	}
+	stillSubscribed := make(map[string]bool, len(inputTopics))
+
+	for i, intopic := range inputTopics {
+		stillSubscribed[intopic] = true
+		oldi, existed := oldIndex[intopic]
+		if !existed {
+			ctrl.Subscribe(intopic, i)
+			continue
+		}
+		windows[i] = resizeWindow(d.windows[oldi], windows[i])
+		if oldi != i {
+			// The subscription key is positional, so it must be
+			// re-established whenever a topic's index shifts.
+			ctrl.Unsubscribe(intopic)
+			ctrl.Subscribe(intopic, i)
+		}
+	}
+	for _, topic := range d.intopics {
+		if !stillSubscribed[topic] {
+			ctrl.Unsubscribe(topic)
+		}
+	}
+
+	newLastAvg, newLastMessageAt, newParseFailures := newTopicStats(len(inputTopics))
+	for i, intopic := range inputTopics {
+		if oldi, existed := oldIndex[intopic]; existed {
+			newLastAvg[i] = d.lastAvg[oldi]
+			newLastMessageAt[i] = d.lastMessageAt[oldi]
+			newParseFailures[i] = d.parseFailures[oldi]
+		}
+	}
 
-	logitem.Debug("Ignoring Config Change:", cchanges)
-	return "", false
+	d.intopics = inputTopics
+	d.outtopics = outtopics
+	d.windows = windows
+	d.aggregators = aggregators
+	d.lastAvg = newLastAvg
+	d.lastMessageAt = newLastMessageAt
+	d.parseFailures = newParseFailures
+
+	switch {
+	case d.hasDurationWindow() && d.done == nil:
+		var deviceCtx context.Context
+		deviceCtx, d.cancel = context.WithCancel(serviceCtx)
+		d.done = make(chan struct{})
+		go d.watchExpiry(deviceCtx, logitem, d.done)
+	case !d.hasDurationWindow() && d.done != nil:
+		// No duration windows remain, so stop the now-pointless expiry
+		// goroutine. We don't wait on d.done here, since watchExpiry also
+		// takes d.mu and we're holding it for the rest of this function.
+		d.cancel()
+		d.cancel = nil
+		d.done = nil
+	}
+
+	logitem.Debug("Reconfigured")
+	return "Reconfigured", true
 }
 
 // ProcessMessage is called upon receiving a pubsub message destined for
@@ -183,19 +413,54 @@ func (d *Device) ProcessMessage(ctrl *framework.DeviceControl, msg framework.Mes
 	logitem := log.WithField("deviceid", ctrl.Id())
 	logitem.Debugf("Processing avg for topic %s", msg.Topic())
 
+	// index is positional and was captured as the subscription key when
+	// this topic was last (re)subscribed. A ProcessConfigChange that runs
+	// between delivery and this handler can shrink, reshuffle, or reorder
+	// the per-topic slices out from under it, so every use below is
+	// guarded by a bounds check against the current slice lengths and,
+	// since reordering leaves the index in bounds but pointing at a
+	// different topic, a check that d.intopics[index] still names the
+	// topic this message was actually published on.
 	index := msg.Key().(int)
+	metricMessagesReceived.WithLabelValues(ctrl.Id(), msg.Topic()).Inc()
+
 	value, err := strconv.ParseFloat(string(msg.Payload()), 64)
 	if err != nil {
 		logitem.Warnf("Failed to convert message (\"%v\") to float64", string(msg.Payload()))
+		metricParseFailures.WithLabelValues(ctrl.Id(), msg.Topic()).Inc()
+		d.mu.Lock()
+		if index >= 0 && index < len(d.parseFailures) && d.intopics[index] == msg.Topic() {
+			d.parseFailures[index]++
+		}
+		d.mu.Unlock()
 		return
 	}
+	if math.IsNaN(value) {
+		metricNaNInputs.WithLabelValues(ctrl.Id(), msg.Topic()).Inc()
+	} else {
+		metricInputValues.WithLabelValues(ctrl.Id(), msg.Topic()).Observe(value)
+	}
 
-	d.addLastValue(index, value)
+	now := time.Now()
+	d.mu.Lock()
+	if index < 0 || index >= len(d.windows) || d.intopics[index] != msg.Topic() {
+		d.mu.Unlock()
+		logitem.Warnf("Dropping message for topic index %d: stale subscription key after a config change", index)
+		return
+	}
+	d.windows[index].add(value, now)
 	avg := d.calculateAverage(index)
+	outtopic := d.outtopics[index]
+	fill := len(d.windows[index].samples)
+	d.lastAvg[index] = avg
+	d.lastMessageAt[index] = now
+	d.mu.Unlock()
 
 	logitem.Debugf("newvalue=%s | avg=%s", utils.FormatFloat64(value), utils.FormatFloat64(avg))
 
-	ctrl.Publish(d.outtopics[index], utils.FormatFloat64(avg))
+	metricWindowFill.WithLabelValues(ctrl.Id(), msg.Topic()).Set(float64(fill))
+	metricAveragesPublished.WithLabelValues(ctrl.Id(), outtopic).Inc()
+	ctrl.Publish(outtopic, utils.FormatFloat64(avg))
 }
 
 // run is the main function that gets called once form main()
@@ -205,6 +470,22 @@ func run(ctx *cli.Context) error {
 
 	log.Info("Starting Math Avg Service")
 
+	shutdownTimeout = ctx.Duration("shutdown-timeout")
+
+	/* Build the root lifecycle context, cancelled on SIGINT/SIGTERM */
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serviceCtx = rootCtx
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Info("Received signal ", sig)
+		log.Warning("Shutting down")
+		cancel()
+	}()
+
 	/* Start framework service client */
 	c, err := framework.StartServiceClientManaged(
 		ctx.String("framework-server"),
@@ -218,6 +499,8 @@ func run(ctx *cli.Context) error {
 		return cli.NewExitError(nil, 1)
 	}
 	defer c.StopClient()
+	setClientConnected(true)
+	defer setClientConnected(false)
 	log.Info("Started service")
 
 	/* Post service's global status */
@@ -234,21 +517,28 @@ func run(ctx *cli.Context) error {
 	}
 	log.Info("Updated Service Config Parameters")
 
-	/* Setup signal channel */
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	/* Start metrics server */
+	var metricsServer *http.Server
+	if ctx.Bool("metrics-enabled") {
+		metricsServer = startMetricsServer(ctx.String("metrics-addr"))
+		log.Info("Started metrics server on ", ctx.String("metrics-addr"))
+	}
+
+	/* Start debug/health admin server */
+	debugServer := startDebugServer(ctx.String("debug-addr"))
+	log.Info("Started debug server on ", ctx.String("debug-addr"))
 
 	/* Post service status indicating I started */
 	if err := c.SetStatus("Started"); err != nil {
 		log.Error("Failed to publish service status: ", err)
 		return cli.NewExitError(nil, 1)
 	}
+	setServiceReady(true)
+	defer setServiceReady(false)
 	log.Info("Published Service Status")
 
-	/* Wait on a signal */
-	sig := <-signals
-	log.Info("Received signal ", sig)
-	log.Warning("Shutting down")
+	/* Wait for the root context to be cancelled by a shutdown signal */
+	<-rootCtx.Done()
 
 	/* Post service's global status */
 	if err := c.SetStatus("Shutting down"); err != nil {
@@ -256,6 +546,31 @@ func run(ctx *cli.Context) error {
 	}
 	log.Info("Published service status")
 
+	/* Give everything shutdownTimeout to stop cleanly, then force-exit */
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer shutdownCancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if metricsServer != nil {
+			if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+				log.Error("Failed to shut down metrics server: ", err)
+			}
+		}
+		if err := debugServer.Shutdown(shutdownCtx); err != nil {
+			log.Error("Failed to shut down debug server: ", err)
+		}
+	}()
+
+	select {
+	case <-done:
+		log.Info("Graceful shutdown complete")
+	case <-shutdownCtx.Done():
+		log.Error("Shutdown timed out after ", shutdownTimeout, "; forcing exit")
+		os.Exit(1)
+	}
+
 	return nil
 }
 
@@ -296,6 +611,29 @@ func main() {
 			Usage:  "debug=5, info=4, warning=3, error=2, fatal=1, panic=0",
 			EnvVar: "LOG_LEVEL",
 		},
+		cli.BoolTFlag{
+			Name:   "metrics-enabled",
+			Usage:  "Enable the Prometheus /metrics HTTP endpoint",
+			EnvVar: "METRICS_ENABLED",
+		},
+		cli.StringFlag{
+			Name:   "metrics-addr",
+			Usage:  "Address to serve Prometheus metrics on",
+			Value:  ":2112",
+			EnvVar: "METRICS_ADDR",
+		},
+		cli.DurationFlag{
+			Name:   "shutdown-timeout",
+			Usage:  "How long to wait for a clean shutdown before forcing exit",
+			Value:  defaultShutdownTimeout,
+			EnvVar: "SHUTDOWN_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "debug-addr",
+			Usage:  "Address to serve the /devices, /healthz, and /readyz debug endpoints on",
+			Value:  ":6060",
+			EnvVar: "DEBUG_ADDR",
+		},
 	}
 
 	/* Launch the application */
@@ -0,0 +1,62 @@
+// Craig Hesling
+// May 25, 2018
+//
+// This file wires up the optional Prometheus /metrics endpoint, modeled on
+// the per-topic counter/histogram conventions used by other OpenChirp
+// services (messages received, parse failures, published results).
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	metricMessagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mathavg_messages_received_total",
+		Help: "Number of input messages received, per device and input topic.",
+	}, []string{"device_id", "topic"})
+
+	metricParseFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mathavg_parse_failures_total",
+		Help: "Number of input messages that failed to parse as a float64.",
+	}, []string{"device_id", "topic"})
+
+	metricNaNInputs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mathavg_nan_inputs_total",
+		Help: "Number of input values that parsed but were NaN.",
+	}, []string{"device_id", "topic"})
+
+	metricAveragesPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mathavg_averages_published_total",
+		Help: "Number of aggregate values published, per device and output topic.",
+	}, []string{"device_id", "topic"})
+
+	metricWindowFill = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mathavg_window_fill",
+		Help: "Current number of samples held in a topic's window.",
+	}, []string{"device_id", "topic"})
+
+	metricInputValues = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "mathavg_input_value",
+		Help: "Distribution of input values received, per device and input topic.",
+	}, []string{"device_id", "topic"})
+)
+
+// startMetricsServer starts the Prometheus /metrics endpoint in the
+// background and returns the *http.Server so the caller can shut it down.
+func startMetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error("Metrics server failed: ", err)
+		}
+	}()
+	return srv
+}
@@ -0,0 +1,129 @@
+// Craig Hesling
+// May 25, 2018
+//
+// This file implements the per-topic sample windows. A window can be
+// bounded either by a fixed sample count (the original behavior) or by a
+// duration, in which case samples are evicted as they age out rather than
+// as new samples arrive.
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+type windowKind int
+
+const (
+	windowByCount windowKind = iota
+	windowByDuration
+)
+
+// sample is a single value paired with the time it was received.
+type sample struct {
+	value float64
+	at    time.Time
+}
+
+// window holds the samples currently inside a topic's averaging window,
+// oldest first.
+type window struct {
+	kind     windowKind
+	capacity int // used when kind == windowByCount
+	duration time.Duration
+	samples  []sample
+}
+
+// parseWindowSpec parses a single WindowSizes element, accepting either a
+// plain sample count ("10") or a duration string ("30s", "5m", "1h") as
+// understood by time.ParseDuration.
+func parseWindowSpec(s string) (*window, error) {
+	if val, err := strconv.ParseInt(s, 10, 32); err == nil {
+		if val <= 0 {
+			val = defaultWindowSize
+		}
+		return &window{kind: windowByCount, capacity: int(val)}, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return nil, fmt.Errorf("not a sample count or duration: %v", err)
+	}
+	if d <= 0 {
+		return nil, fmt.Errorf("duration must be positive")
+	}
+	return &window{kind: windowByDuration, duration: d}, nil
+}
+
+// add appends a new sample, evicting whatever the window's policy makes
+// stale as of the same timestamp.
+func (w *window) add(value float64, at time.Time) {
+	w.samples = append(w.samples, sample{value: value, at: at})
+	if w.kind == windowByCount {
+		if len(w.samples) > w.capacity {
+			w.samples = w.samples[len(w.samples)-w.capacity:]
+		}
+		return
+	}
+	w.evict(at)
+}
+
+// evict drops samples older than the window's duration as of now. It is a
+// no-op for count-based windows and returns the number of samples dropped.
+func (w *window) evict(now time.Time) int {
+	if w.kind != windowByDuration {
+		return 0
+	}
+	cutoff := now.Add(-w.duration)
+	i := 0
+	for i < len(w.samples) && w.samples[i].at.Before(cutoff) {
+		i++
+	}
+	if i == 0 {
+		return 0
+	}
+	w.samples = w.samples[i:]
+	return i
+}
+
+// values returns the window's current samples, oldest first.
+func (w *window) values() []float64 {
+	vals := make([]float64, len(w.samples))
+	for i, s := range w.samples {
+		vals[i] = s.value
+	}
+	return vals
+}
+
+// resizeWindow migrates old's samples into next, a freshly parsed window
+// spec for the same topic. Count windows keep the newest min(old,new)
+// samples, padding the front with NaN when the window grows. Duration
+// windows simply inherit the timestamped samples and re-evict against the
+// new duration.
+func resizeWindow(old, next *window) *window {
+	if next.kind == windowByDuration {
+		next.samples = append([]sample(nil), old.samples...)
+		next.evict(time.Now())
+		return next
+	}
+
+	oldValues := old.values()
+	switch {
+	case len(oldValues) > next.capacity:
+		oldValues = oldValues[len(oldValues)-next.capacity:]
+	case len(oldValues) < next.capacity:
+		pad := make([]float64, next.capacity-len(oldValues))
+		for i := range pad {
+			pad[i] = math.NaN()
+		}
+		oldValues = append(pad, oldValues...)
+	}
+
+	now := time.Now()
+	next.samples = make([]sample, len(oldValues))
+	for i, v := range oldValues {
+		next.samples[i] = sample{value: v, at: now}
+	}
+	return next
+}